@@ -0,0 +1,220 @@
+// Copyright (c) 2015, Alex A Skinner
+// see LICENSE file
+
+package aassh
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// defaultChunkSize and defaultConcurrency are the ParallelOpts fallbacks
+// PushFileParallel uses when the caller leaves them zero.
+const (
+	defaultChunkSize   = 4 << 20 // 4MiB
+	defaultConcurrency = 4
+)
+
+// ParallelOpts configures PushFileParallel.
+type ParallelOpts struct {
+	// ChunkSize is the byte range each worker writes per chunk. Defaults
+	// to 4MiB.
+	ChunkSize int64
+	// Concurrency is the number of sftp sessions writing chunks at once.
+	// Defaults to 4.
+	Concurrency int
+	// ProgressFunc, if set, is called after each chunk completes with the
+	// cumulative bytes transferred and the total file size.
+	ProgressFunc func(bytesTransferred, total int64)
+}
+
+type fileChunk struct {
+	offset, length int64
+}
+
+// splitChunks divides a size-byte file into chunkSize-byte ranges, the last
+// of which is shortened to whatever remains.
+func splitChunks(size, chunkSize int64) []fileChunk {
+	var chunks []fileChunk
+	for off := int64(0); off < size; off += chunkSize {
+		length := chunkSize
+		if off+length > size {
+			length = size - off
+		}
+		chunks = append(chunks, fileChunk{off, length})
+	}
+	return chunks
+}
+
+// distributeChunks feeds chunks to chunkc in order, then closes chunkc.  If
+// stopc is closed first it skips the remaining sends and returns early
+// (still closing chunkc), so a producer never blocks forever sending to a
+// channel no worker is still reading.
+func distributeChunks(chunkc chan<- fileChunk, chunks []fileChunk, stopc <-chan struct{}) {
+	defer close(chunkc)
+	for _, ch := range chunks {
+		select {
+		case chunkc <- ch:
+		case <-stopc:
+			return
+		}
+	}
+}
+
+// PushFileParallel uploads src to dest over Concurrency concurrent sftp
+// sessions on the same underlying ssh.Client, splitting the file into
+// ChunkSize ranges and writing each with WriteAt against a pre-truncated
+// remote file, for throughput a single SCP/SFTP stream can't reach on
+// high-latency WAN links.  The remote file is written at a temporary path
+// and renamed into place once every chunk has landed.
+func (c *SSHClient) PushFileParallel(src, dest string, opts ParallelOpts) error {
+	chunkSize := opts.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = defaultChunkSize
+	}
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultConcurrency
+	}
+
+	fileSrc, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer fileSrc.Close()
+	srcStat, err := fileSrc.Stat()
+	if err != nil {
+		return err
+	}
+	size := srcStat.Size()
+
+	sc, err := c.sftpClient()
+	if err != nil {
+		return err
+	}
+	defer sc.Close()
+
+	tmp := dest + ".aassh-part"
+	remote, err := sc.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	if err = remote.Truncate(size); err != nil {
+		remote.Close()
+		sc.Remove(tmp)
+		return err
+	}
+	remote.Close()
+
+	chunks := splitChunks(size, chunkSize)
+
+	chunkc := make(chan fileChunk)
+	errc := make(chan error, concurrency)
+	stopc := make(chan struct{})
+	var stopOnce sync.Once
+	stop := func() { stopOnce.Do(func() { close(stopc) }) }
+	var progressMu sync.Mutex
+	var transferred int64
+	var wg sync.WaitGroup
+
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := c.pushChunks(fileSrc, tmp, chunkc, func(n int64) {
+				if opts.ProgressFunc == nil {
+					return
+				}
+				progressMu.Lock()
+				transferred += n
+				opts.ProgressFunc(transferred, size)
+				progressMu.Unlock()
+			}); err != nil {
+				errc <- err
+				// wake the producer in case every worker has now died,
+				// which would otherwise leave it blocked forever trying
+				// to send to a channel nothing is reading anymore.
+				stop()
+			}
+		}()
+	}
+
+	go distributeChunks(chunkc, chunks, stopc)
+
+	wg.Wait()
+	close(errc)
+	for err := range errc {
+		if err != nil {
+			sc.Remove(tmp)
+			return err
+		}
+	}
+
+	if f, err := sc.OpenFile(tmp, os.O_WRONLY); err == nil {
+		// best-effort: not every sftp server supports fsync@openssh.com.
+		_ = f.Sync()
+		f.Close()
+	}
+
+	if err = sc.Chmod(tmp, srcStat.Mode().Perm()); err != nil {
+		sc.Remove(tmp)
+		return err
+	}
+	if err = sc.PosixRename(tmp, dest); err != nil {
+		sc.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// chunkWriterAt is the part of *sftp.File pushChunks needs, narrowed so
+// copyChunk can be unit tested against an in-memory fake.
+type chunkWriterAt interface {
+	WriteAt(b []byte, off int64) (int, error)
+}
+
+// copyChunk reads ch's byte range out of fileSrc and writes it to the
+// matching offset in w, reusing buf when it's already big enough and
+// returning whichever buffer was actually used so the caller can reuse it
+// for the next chunk.
+func copyChunk(fileSrc io.ReaderAt, w chunkWriterAt, buf []byte, ch fileChunk) ([]byte, error) {
+	if cap(buf) < int(ch.length) {
+		buf = make([]byte, ch.length)
+	}
+	b := buf[:ch.length]
+	if _, err := fileSrc.ReadAt(b, ch.offset); err != nil {
+		return buf, err
+	}
+	if _, err := w.WriteAt(b, ch.offset); err != nil {
+		return buf, err
+	}
+	return buf, nil
+}
+
+// pushChunks opens its own sftp session against tmp and drains chunkc,
+// reading each chunk's byte range out of fileSrc and writing it to the
+// matching offset in tmp, until chunkc is closed or an error occurs.
+func (c *SSHClient) pushChunks(fileSrc *os.File, tmp string, chunkc <-chan fileChunk, onChunk func(n int64)) error {
+	sc, err := c.sftpClient()
+	if err != nil {
+		return err
+	}
+	defer sc.Close()
+	f, err := sc.OpenFile(tmp, os.O_WRONLY)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var buf []byte
+	for ch := range chunkc {
+		var err error
+		buf, err = copyChunk(fileSrc, f, buf, ch)
+		if err != nil {
+			return err
+		}
+		onChunk(ch.length)
+	}
+	return nil
+}
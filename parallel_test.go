@@ -0,0 +1,134 @@
+// Copyright (c) 2015, Alex A Skinner
+// see LICENSE file
+
+package aassh
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestSplitChunks(t *testing.T) {
+	cases := []struct {
+		name      string
+		size      int64
+		chunkSize int64
+		want      []fileChunk
+	}{
+		{"empty file", 0, 10, nil},
+		{"exact multiple", 20, 10, []fileChunk{{0, 10}, {10, 10}}},
+		{"short last chunk", 25, 10, []fileChunk{{0, 10}, {10, 10}, {20, 5}}},
+		{"single chunk bigger than file", 5, 10, []fileChunk{{0, 5}}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := splitChunks(tc.size, tc.chunkSize)
+			if len(got) != len(tc.want) {
+				t.Fatalf("splitChunks(%d, %d) = %v, want %v", tc.size, tc.chunkSize, got, tc.want)
+			}
+			for i := range got {
+				if got[i] != tc.want[i] {
+					t.Fatalf("splitChunks(%d, %d)[%d] = %v, want %v", tc.size, tc.chunkSize, i, got[i], tc.want[i])
+				}
+			}
+		})
+	}
+}
+
+// fakeWriterAt is a minimal chunkWriterAt backed by an in-memory buffer, for
+// exercising copyChunk without a live sftp session.
+type fakeWriterAt struct {
+	buf []byte
+}
+
+func (f *fakeWriterAt) WriteAt(b []byte, off int64) (int, error) {
+	end := off + int64(len(b))
+	if end > int64(len(f.buf)) {
+		grown := make([]byte, end)
+		copy(grown, f.buf)
+		f.buf = grown
+	}
+	copy(f.buf[off:end], b)
+	return len(b), nil
+}
+
+func TestCopyChunk(t *testing.T) {
+	src := []byte("0123456789abcdef")
+	w := &fakeWriterAt{}
+	buf, err := copyChunk(bytes.NewReader(src), w, nil, fileChunk{offset: 4, length: 6})
+	if err != nil {
+		t.Fatalf("copyChunk: %v", err)
+	}
+	if got, want := string(w.buf[4:10]), "456789"; got != want {
+		t.Fatalf("written bytes = %q, want %q", got, want)
+	}
+	if len(buf) < 6 {
+		t.Fatalf("returned buf too small to reuse: len=%d", len(buf))
+	}
+
+	// a second call reusing buf should grow it rather than reuse a
+	// too-small slice.
+	buf, err = copyChunk(bytes.NewReader(src), w, buf, fileChunk{offset: 0, length: 16})
+	if err != nil {
+		t.Fatalf("copyChunk (reuse): %v", err)
+	}
+	if got, want := string(w.buf), src; got != string(want) {
+		t.Fatalf("written bytes = %q, want %q", got, want)
+	}
+	_ = buf
+}
+
+func TestCopyChunkReadError(t *testing.T) {
+	w := &fakeWriterAt{}
+	_, err := copyChunk(bytes.NewReader(nil), w, nil, fileChunk{offset: 0, length: 4})
+	if err == nil {
+		t.Fatal("expected an error reading past the end of an empty source, got nil")
+	}
+}
+
+func TestDistributeChunksClosesChannel(t *testing.T) {
+	chunks := splitChunks(30, 10)
+	chunkc := make(chan fileChunk)
+	stopc := make(chan struct{})
+
+	go distributeChunks(chunkc, chunks, stopc)
+
+	var got []fileChunk
+	for ch := range chunkc {
+		got = append(got, ch)
+	}
+	if len(got) != len(chunks) {
+		t.Fatalf("received %d chunks, want %d", len(got), len(chunks))
+	}
+}
+
+// TestDistributeChunksStopsOnSignal checks that closing stopc unblocks a
+// distributeChunks goroutine stuck sending to a channel nothing reads from
+// anymore - the deadlock the chunk0-6 fix addresses when every worker dies.
+func TestDistributeChunksStopsOnSignal(t *testing.T) {
+	chunks := splitChunks(100, 10)
+	chunkc := make(chan fileChunk) // nobody reads this
+	stopc := make(chan struct{})
+
+	done := make(chan struct{})
+	go func() {
+		distributeChunks(chunkc, chunks, stopc)
+		close(done)
+	}()
+
+	close(stopc)
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("distributeChunks did not return after stopc was closed - producer deadlocked")
+	}
+}
+
+func Example_splitChunks() {
+	chunks := splitChunks(25, 10)
+	fmt.Println(len(chunks))
+	// Output: 3
+}
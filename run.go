@@ -0,0 +1,80 @@
+// Copyright (c) 2015, Alex A Skinner
+// see LICENSE file
+
+package aassh
+
+import (
+	"context"
+	"golang.org/x/crypto/ssh"
+	"io"
+)
+
+// PtyRequest describes a pseudo-terminal for RunCmdStream to allocate before
+// starting the remote command, for interactive commands (sudo prompts, vim)
+// that the plain RunCmd/RunCmdStream pipes can't service.
+type PtyRequest struct {
+	Term  string
+	H, W  int
+	Modes ssh.TerminalModes
+}
+
+// RunCmdStream runs cmd on the host to which the connection is currently
+// established, wiring the session's stdout and stderr directly to the given
+// writers and forwarding stdin (if non-nil) to the remote process, rather
+// than buffering everything in memory as RunCmd does.  If pty is non-nil, a
+// pseudo-terminal is requested before the command starts.
+//
+// If ctx is cancelled before the command finishes, the remote process is
+// sent SIGKILL and the session is closed.  The remote exit status is
+// returned directly as exitCode; err is non-nil only for local/transport
+// failures, not for a non-zero remote exit.
+func (c *SSHClient) RunCmdStream(ctx context.Context, cmd string, stdin io.Reader, stdout, stderr io.Writer, pty *PtyRequest) (exitCode int, err error) {
+	sess, err := c.client.NewSession()
+	if err != nil {
+		return -1, err
+	}
+	defer sess.Close()
+
+	sess.Stdout = stdout
+	sess.Stderr = stderr
+	if stdin != nil {
+		in, err := sess.StdinPipe()
+		if err != nil {
+			return -1, err
+		}
+		go func() {
+			io.Copy(in, stdin)
+			in.Close()
+		}()
+	}
+
+	if pty != nil {
+		if err = sess.RequestPty(pty.Term, pty.H, pty.W, pty.Modes); err != nil {
+			return -1, err
+		}
+	}
+
+	if err = sess.Start(cmd); err != nil {
+		return -1, err
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- sess.Wait() }()
+
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		sess.Signal(ssh.SIGKILL)
+		sess.Close()
+		<-done
+		return -1, ctx.Err()
+	}
+
+	if err == nil {
+		return 0, nil
+	}
+	if exitErr, ok := err.(*ssh.ExitError); ok {
+		return exitErr.ExitStatus(), nil
+	}
+	return -1, err
+}
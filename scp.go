@@ -24,9 +24,19 @@ func permString(f *os.File) string {
 }
 
 // PushBytes is used to push bytes from memory without writing a file first.
-// dest should be the full remote path, and perms a typical permission string - 
+// dest should be the full remote path, and perms a typical permission string -
 // eg "0644"
+// It honors c.TransferMode, preferring sftp and falling back to scp.
 func (c *SSHClient) PushBytes(b []byte, dest, perms string) error {
+	if c.TransferMode == TransferSFTP {
+		if err := c.SFTPPushBytes(b, dest, perms); err == nil {
+			return nil
+		}
+	}
+	return c.scpPushBytes(b, dest, perms)
+}
+
+func (c *SSHClient) scpPushBytes(b []byte, dest, perms string) error {
 	sess, err := c.client.NewSession()
 	if err != nil {
 		return err
@@ -79,7 +89,17 @@ func (c *SSHClient) PushBytes(b []byte, dest, perms string) error {
 
 // PushFile sends local file src to remote host to file/folder dest.
 // If preserve is set, timestamps are preserved.
+// It honors c.TransferMode, preferring sftp and falling back to scp.
 func (c *SSHClient) PushFile(src, dest string, preserve bool) error {
+	if c.TransferMode == TransferSFTP {
+		if err := c.SFTPPushFile(src, dest, preserve); err == nil {
+			return nil
+		}
+	}
+	return c.scpPushFile(src, dest, preserve)
+}
+
+func (c *SSHClient) scpPushFile(src, dest string, preserve bool) error {
 	flags := "qrt"
 	if preserve {
 		flags = "p" + flags
@@ -124,7 +144,17 @@ func (c *SSHClient) PushFile(src, dest string, preserve bool) error {
 
 // PushDir sends local folder src to remote host to folder dest.
 // If preserve is set, timestamps are kept.
+// It honors c.TransferMode, preferring sftp and falling back to scp.
 func (c *SSHClient) PushDir(src string, dest string, preserve bool) error {
+	if c.TransferMode == TransferSFTP {
+		if err := c.SFTPPushDir(src, dest, preserve); err == nil {
+			return nil
+		}
+	}
+	return c.scpPushDir(src, dest, preserve)
+}
+
+func (c *SSHClient) scpPushDir(src string, dest string, preserve bool) error {
 	flags := "qrt"
 	if preserve {
 		flags = "p" + flags
@@ -229,6 +259,29 @@ func writeFile(w io.WriteCloser, src, dest string, preserve bool) error {
 	return err
 }
 
+// scpError reports a failure during a specific phase of the SCP sink state
+// machine (handleIncoming), identifying the local path involved.
+type scpError struct {
+	Path  string
+	Phase string
+	Err   error
+}
+
+func (e *scpError) Error() string {
+	return fmt.Sprintf("scp %s %s: %v", e.Phase, e.Path, e.Err)
+}
+
+func (e *scpError) Unwrap() error {
+	return e.Err
+}
+
+// sinkError reports err to the remote as a fatal SCP error (\x02 followed
+// by a message and a newline) and returns it, for the caller to abort on.
+func sinkError(w io.Writer, err error) error {
+	fmt.Fprintf(w, "\x02%s\n", err)
+	return err
+}
+
 func makeTS(ts string) (time.Time, time.Time, error) {
 	var mtime, atime time.Time
 	if len(ts) > 0 {
@@ -253,22 +306,31 @@ func makeTS(ts string) (time.Time, time.Time, error) {
 	return mtime, atime, nil
 }
 
-func handleFile(b *bufio.Reader, ln, dest, ts string) error {
+// handleFile consumes a C (copy-file) record: the header line ln, followed
+// on bufr by exactly size bytes of file content and one terminating null
+// byte, as the SCP protocol specifies.
+//
+// Real scp sources block reading an ack right after sending the C header,
+// and only then write the file body - they don't wait for a second ack
+// until the trailing null has been read.  So the header must be acked on w
+// as soon as it's parsed, before we block reading the body off bufr, or a
+// real scp -t/-f remote and this sink deadlock waiting on each other.
+func handleFile(w io.Writer, bufr *bufio.Reader, ln, dest, ts string) error {
 	spln := strings.Split(ln, " ")
 	if len(spln) != 3 {
-		return fmt.Errorf("Length of create must be 3, got %d", len(spln))
+		return &scpError{Path: dest, Phase: "parse-create", Err: fmt.Errorf("Length of create must be 3, got %d", len(spln))}
 	}
 	if len(spln[0]) != 5 {
-		return fmt.Errorf("Length of create header must be 5, C####.  Got %s", spln[0])
+		return &scpError{Path: dest, Phase: "parse-create", Err: fmt.Errorf("Length of create header must be 5, C####.  Got %s", spln[0])}
 	}
 	mode, err := strconv.ParseUint(spln[0][1:], 8, 32)
 	if err != nil {
-		return err
+		return &scpError{Path: dest, Phase: "parse-create", Err: err}
 	}
 	fimode := os.FileMode(mode)
-	fisize, err := strconv.Atoi(spln[1])
+	fisize, err := strconv.ParseInt(spln[1], 10, 64)
 	if err != nil {
-		return err
+		return &scpError{Path: dest, Phase: "parse-create", Err: err}
 	}
 	finame := dest
 	dstf, err := os.Stat(dest)
@@ -279,49 +341,50 @@ func handleFile(b *bufio.Reader, ln, dest, ts string) error {
 	}
 	mtime, atime, err := makeTS(ts)
 	if err != nil {
-		return err
+		return &scpError{Path: finame, Phase: "parse-timestamp", Err: err}
 	}
-	byt := make([]byte, fisize)
-	_, err = b.Read(byt)
+	f, err := os.OpenFile(finame, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fimode)
 	if err != nil {
-		return err
+		return &scpError{Path: finame, Phase: "open", Err: err}
 	}
-	f, err := os.OpenFile(finame, os.O_WRONLY|os.O_CREATE, fimode)
-	if err != nil {
-		return err
+	if _, err = fmt.Fprint(w, "\x00"); err != nil {
+		f.Close()
+		return &scpError{Path: finame, Phase: "ack-header", Err: err}
 	}
-	_, err = f.Write(byt)
+	_, err = io.CopyN(f, bufr, fisize)
 	if err != nil {
 		f.Close()
-		return err
+		return &scpError{Path: finame, Phase: "write", Err: err}
 	}
 	f.Close()
+	// the sender always terminates the data with a single null byte.
+	if _, err = bufr.ReadByte(); err != nil {
+		return &scpError{Path: finame, Phase: "read-terminator", Err: err}
+	}
 	if len(ts) > 0 {
-		err = os.Chtimes(finame, atime, mtime)
-		if err != nil {
-			return err
+		if err = os.Chtimes(finame, atime, mtime); err != nil {
+			return &scpError{Path: finame, Phase: "chtimes", Err: err}
 		}
 	}
-	_, _ = b.Read([]byte{'0'})
 	return nil
 }
 
 func handleDir(ln, ts, dest string) (string, error) {
 	spln := strings.Split(ln, " ")
 	if len(spln) != 3 {
-		return "", fmt.Errorf("Length of directory must be 3, got %d", len(spln))
+		return "", &scpError{Path: dest, Phase: "parse-directory", Err: fmt.Errorf("Length of directory must be 3, got %d", len(spln))}
 	}
 	if len(spln[0]) != 5 {
-		return "", fmt.Errorf("Length of directory header must be 5, D####.  Got %s", spln[0])
+		return "", &scpError{Path: dest, Phase: "parse-directory", Err: fmt.Errorf("Length of directory header must be 5, D####.  Got %s", spln[0])}
 	}
 	mode, err := strconv.ParseUint(spln[0][1:], 8, 32)
 	if err != nil {
-		return "", err
+		return "", &scpError{Path: dest, Phase: "parse-directory", Err: err}
 	}
 	fimode := os.FileMode(mode)
 	mtime, atime, err := makeTS(ts)
 	if err != nil {
-		return "", err
+		return "", &scpError{Path: dest, Phase: "parse-timestamp", Err: err}
 	}
 	dirname := dest
 	st, err := os.Stat(dest)
@@ -334,23 +397,29 @@ func handleDir(ln, ts, dest string) (string, error) {
 	}
 	err = os.MkdirAll(dirname, fimode)
 	if err != nil {
-		return "", err
+		return "", &scpError{Path: dirname, Phase: "mkdir", Err: err}
 	}
 	if len(ts) > 0 {
 		err = os.Chtimes(dirname, atime, mtime)
 		if err != nil {
-			return "", err
+			return "", &scpError{Path: dirname, Phase: "chtimes", Err: err}
 		}
 	}
 	return dirname, nil
 }
 
+// handleIncoming implements the SCP sink side of the protocol: it reads
+// control records (C/D/T/E) and acks each with a \x00.  D/T/E records get
+// exactly one ack, sent here once the record is handled.  C records get
+// two: handleFile sends the first right after parsing the header (the real
+// scp source blocks on it before writing the file body), and the ack sent
+// here is the second, for the body + trailing null.  A \x01-prefixed line
+// is a non-fatal remote warning (eg from scp -v) and needs no ack; a
+// \x02-prefixed line is a fatal remote error and aborts the transfer.  Any
+// local failure is reported back to the remote as a \x02 record before
+// aborting, per spec.
 func handleIncoming(w io.WriteCloser, r io.Reader, rr io.Reader, dest string) error {
 	bufr := bufio.NewReader(r)
-	_, err := fmt.Fprint(w, "\x00")
-	if err != nil {
-		return err
-	}
 	ts := ""
 	cwd, err := os.Getwd()
 	if err != nil {
@@ -359,26 +428,30 @@ func handleIncoming(w io.WriteCloser, r io.Reader, rr io.Reader, dest string) er
 	if !strings.HasPrefix(dest, "/") {
 		dest = cwd + "/" + dest
 	}
-	for ln, err := bufr.ReadString('\n'); err == nil; ln, err = bufr.ReadString('\n') {
+	if _, err := fmt.Fprint(w, "\x00"); err != nil {
+		return err
+	}
+	for {
+		ln, err := bufr.ReadString('\n')
 		if err != nil {
-			if err.Error() == "EOF" {
+			if err == io.EOF {
 				return nil
 			}
 			return err
 		}
-		ln = strings.TrimSpace(ln)
+		ln = strings.TrimRight(ln, "\r\n")
 		if len(ln) == 0 {
 			continue
 		}
-		_, err = fmt.Fprint(w, "\x00")
-		if err != nil {
-			return err
-		}
 		switch ln[0] {
+		case 1:
+			// non-fatal warning from the remote (eg scp -v); no ack due.
+			continue
+		case 2:
+			return &scpError{Path: dest, Phase: "remote", Err: fmt.Errorf("%s", ln[1:])}
 		case 'C':
-			err = handleFile(bufr, ln, dest, ts)
-			if err != nil {
-				return err
+			if err = handleFile(w, bufr, ln, dest, ts); err != nil {
+				return sinkError(w, err)
 			}
 			ts = ""
 		case 'T':
@@ -386,20 +459,20 @@ func handleIncoming(w io.WriteCloser, r io.Reader, rr io.Reader, dest string) er
 		case 'D':
 			dest, err = handleDir(ln, ts, dest)
 			if err != nil {
-				return err
+				return sinkError(w, err)
 			}
 			ts = ""
 		case 'E':
 			spldest := strings.Split(strings.TrimRight(dest, "/"), "/")
 			dest = strings.Join(spldest[:len(spldest)-1], "/")
 			ts = ""
+		default:
+			return sinkError(w, &scpError{Path: dest, Phase: "parse", Err: fmt.Errorf("unrecognized control byte %q", ln[0])})
 		}
-		_, err = fmt.Fprint(w, "\x00")
-		if err != nil {
+		if _, err := fmt.Fprint(w, "\x00"); err != nil {
 			return err
 		}
 	}
-	return err
 }
 
 func walkDir(w io.WriteCloser, dir string, preserve bool) error {
@@ -447,7 +520,17 @@ func walkDir(w io.WriteCloser, dir string, preserve bool) error {
 
 // Receive receives a file or folder from remote host at location src, and
 // writes it to local machine as dest.
+// It honors c.TransferMode, preferring sftp and falling back to scp.
 func (c *SSHClient) Receive(src, dest string) error {
+	if c.TransferMode == TransferSFTP {
+		if err := c.SFTPReceive(src, dest); err == nil {
+			return nil
+		}
+	}
+	return c.scpReceive(src, dest)
+}
+
+func (c *SSHClient) scpReceive(src, dest string) error {
 	sess, err := c.client.NewSession()
 	if err != nil {
 		return err
@@ -0,0 +1,157 @@
+// Copyright (c) 2015, Alex A Skinner
+// see LICENSE file
+
+package aassh
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// nopWriteCloser adapts an io.Writer to io.WriteCloser for tests that don't
+// care about close semantics.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// TestHandleIncomingAcksHeaderBeforeBody drives handleIncoming over a pair of
+// io.Pipes playing the role of a real scp source: it blocks reading the ack
+// for a C header before writing the file body, exactly like /usr/bin/scp
+// does.  Before the chunk0-5 fix this deadlocked, since handleIncoming only
+// acked after reading the whole record; io.Pipe's synchronous Write makes
+// that deadlock observable instead of silently passing.
+func TestHandleIncomingAcksHeaderBeforeBody(t *testing.T) {
+	dest := t.TempDir()
+	body := []byte("hello, scp")
+
+	toSink, fromSource := io.Pipe() // source -> sink (r)
+	fromSink, toSource := io.Pipe() // sink -> source (w)
+
+	result := make(chan error, 1)
+	go func() {
+		result <- handleIncoming(toSource, toSink, nil, dest)
+	}()
+
+	readAck := func() byte {
+		b := make([]byte, 1)
+		if _, err := io.ReadFull(fromSink, b); err != nil {
+			t.Fatalf("reading ack: %v", err)
+		}
+		return b[0]
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// initial sink ack before any records are sent.
+		readAck()
+
+		fmt.Fprintf(fromSource, "C0644 %d out\n", len(body))
+		// a real source blocks here for the header ack before writing the
+		// body - if the sink were still reading the whole record before
+		// acking, this would hang until the test times out.
+		readAck()
+
+		fromSource.Write(body)
+		fromSource.Write([]byte{0})
+		// second ack, for the body + trailing null.
+		readAck()
+
+		fromSource.Close()
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for ack sequence - handleIncoming deadlocked")
+	}
+
+	if err := <-result; err != nil {
+		t.Fatalf("handleIncoming: %v", err)
+	}
+
+	got, err := os.ReadFile(filepath.Join(dest, "out"))
+	if err != nil {
+		t.Fatalf("reading received file: %v", err)
+	}
+	if !bytes.Equal(got, body) {
+		t.Fatalf("received file = %q, want %q", got, body)
+	}
+}
+
+// TestHandleIncomingRemoteError checks that a \x02-prefixed line from the
+// remote is surfaced as a fatal error rather than being treated as a normal
+// control record.
+func TestHandleIncomingRemoteError(t *testing.T) {
+	dest := t.TempDir()
+	r := strings.NewReader("\x02permission denied\n")
+	var w bytes.Buffer
+
+	err := handleIncoming(nopWriteCloser{&w}, r, nil, dest)
+	if err == nil {
+		t.Fatal("expected an error for a remote \\x02 record, got nil")
+	}
+	se, ok := err.(*scpError)
+	if !ok {
+		t.Fatalf("expected *scpError, got %T: %v", err, err)
+	}
+	if se.Phase != "remote" {
+		t.Fatalf("Phase = %q, want %q", se.Phase, "remote")
+	}
+	if !strings.Contains(se.Error(), "permission denied") {
+		t.Fatalf("error %q does not mention remote message", se.Error())
+	}
+}
+
+// TestHandleFileParseErrors table-drives handleFile's header validation.
+func TestHandleFileParseErrors(t *testing.T) {
+	dest := t.TempDir()
+	cases := []struct {
+		name string
+		ln   string
+	}{
+		{"wrong field count", "0644 10"},
+		{"short mode field", "C64 10 out"},
+		{"non-octal mode", "C06XX 10 out"},
+		{"non-numeric size", "C0644 ten out"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var w bytes.Buffer
+			bufr := bufio.NewReader(strings.NewReader(""))
+			err := handleFile(&w, bufr, tc.ln, filepath.Join(dest, "out"), "")
+			if err == nil {
+				t.Fatalf("handleFile(%q): expected an error, got nil", tc.ln)
+			}
+		})
+	}
+}
+
+// TestHandleDirParseErrors table-drives handleDir's header validation.
+func TestHandleDirParseErrors(t *testing.T) {
+	dest := t.TempDir()
+	cases := []struct {
+		name string
+		ln   string
+	}{
+		{"wrong field count", "0755 0"},
+		{"short mode field", "D75 0 sub"},
+		{"non-octal mode", "D07XX 0 sub"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := handleDir(tc.ln, "", dest); err == nil {
+				t.Fatalf("handleDir(%q): expected an error, got nil", tc.ln)
+			}
+		})
+	}
+}
@@ -0,0 +1,209 @@
+// Copyright (c) 2015, Alex A Skinner
+// see LICENSE file
+
+package aassh
+
+import (
+	"github.com/pkg/sftp"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// sftpClient opens an sftp subsystem session on the existing ssh.Client.
+// Callers are responsible for closing the returned client.
+func (c *SSHClient) sftpClient() (*sftp.Client, error) {
+	return sftp.NewClient(c.client)
+}
+
+// SFTPPushBytes is the sftp equivalent of PushBytes - it pushes bytes from
+// memory without writing a local file first.  dest should be the full
+// remote path, and perms a typical permission string - eg "0644".
+func (c *SSHClient) SFTPPushBytes(b []byte, dest, perms string) error {
+	sc, err := c.sftpClient()
+	if err != nil {
+		return err
+	}
+	defer sc.Close()
+	f, err := sc.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err = f.Write(b); err != nil {
+		return err
+	}
+	mode, err := strconv.ParseUint(perms, 8, 32)
+	if err != nil {
+		return err
+	}
+	return sc.Chmod(dest, os.FileMode(mode))
+}
+
+// SFTPPushFile is the sftp equivalent of PushFile - it sends local file src
+// to remote host at the file path dest; an existing remote directory at dest
+// is not written into.  If preserve is set, timestamps are preserved.
+func (c *SSHClient) SFTPPushFile(src, dest string, preserve bool) error {
+	sc, err := c.sftpClient()
+	if err != nil {
+		return err
+	}
+	defer sc.Close()
+	return sftpPushFile(sc, src, dest, preserve)
+}
+
+// sftpPushFile writes src to the literal remote path dest - it does not
+// special-case dest already existing as a remote directory, matching
+// scpPushFile/writeFile's semantics so PushFile behaves the same regardless
+// of which transport c.TransferMode picks.
+func sftpPushFile(sc *sftp.Client, src, dest string, preserve bool) error {
+	fileSrc, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer fileSrc.Close()
+	srcStat, err := fileSrc.Stat()
+	if err != nil {
+		return err
+	}
+	f, err := sc.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err = io.Copy(f, fileSrc); err != nil {
+		return err
+	}
+	if err = sc.Chmod(dest, srcStat.Mode().Perm()); err != nil {
+		return err
+	}
+	if preserve {
+		mtime := srcStat.ModTime()
+		if err = sc.Chtimes(dest, mtime, mtime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SFTPPushDir is the sftp equivalent of PushDir - it sends local folder src
+// to remote host to folder dest.  If preserve is set, timestamps are kept.
+func (c *SSHClient) SFTPPushDir(src string, dest string, preserve bool) error {
+	sc, err := c.sftpClient()
+	if err != nil {
+		return err
+	}
+	defer sc.Close()
+	return sftpPushDir(sc, src, dest, preserve)
+}
+
+func sftpPushDir(sc *sftp.Client, src, dest string, preserve bool) error {
+	srcStat, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if err = sc.MkdirAll(dest); err != nil {
+		return err
+	}
+	if err = sc.Chmod(dest, srcStat.Mode().Perm()); err != nil {
+		return err
+	}
+	if preserve {
+		mtime := srcStat.ModTime()
+		if err = sc.Chtimes(dest, mtime, mtime); err != nil {
+			return err
+		}
+	}
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		childSrc := filepath.Join(src, e.Name())
+		childDest := filepath.Join(dest, e.Name())
+		if e.IsDir() {
+			if err = sftpPushDir(sc, childSrc, childDest, preserve); err != nil {
+				return err
+			}
+			continue
+		}
+		if err = sftpPushFile(sc, childSrc, childDest, preserve); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SFTPReceive is the sftp equivalent of Receive - it receives a file or
+// folder from remote host at location src, and writes it to local machine
+// as dest.
+func (c *SSHClient) SFTPReceive(src, dest string) error {
+	sc, err := c.sftpClient()
+	if err != nil {
+		return err
+	}
+	defer sc.Close()
+	srcStat, err := sc.Stat(src)
+	if err != nil {
+		return err
+	}
+	if srcStat.IsDir() {
+		return sftpReceiveDir(sc, src, dest)
+	}
+	return sftpReceiveFile(sc, src, dest)
+}
+
+func sftpReceiveFile(sc *sftp.Client, src, dest string) error {
+	srcStat, err := sc.Stat(src)
+	if err != nil {
+		return err
+	}
+	local := dest
+	if dstStat, err := os.Stat(dest); err == nil && dstStat.IsDir() {
+		local = filepath.Join(dest, filepath.Base(src))
+	}
+	f, err := sc.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	out, err := os.OpenFile(local, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, srcStat.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if _, err = io.Copy(out, f); err != nil {
+		return err
+	}
+	mtime := srcStat.ModTime()
+	return os.Chtimes(local, mtime, mtime)
+}
+
+func sftpReceiveDir(sc *sftp.Client, src, dest string) error {
+	srcStat, err := sc.Stat(src)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(dest, srcStat.Mode().Perm()); err != nil {
+		return err
+	}
+	entries, err := sc.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		childSrc := filepath.Join(src, e.Name())
+		childDest := filepath.Join(dest, e.Name())
+		if e.IsDir() {
+			if err = sftpReceiveDir(sc, childSrc, childDest); err != nil {
+				return err
+			}
+			continue
+		}
+		if err = sftpReceiveFile(sc, childSrc, childDest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -10,17 +10,122 @@ package aassh
 
 import (
 	"bytes"
-	"code.google.com/p/go.crypto/ssh"
+	"errors"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 	"io/ioutil"
+	"net"
+	"os"
 	"os/user"
+	"sync"
+	"time"
+)
+
+// maxKeepAliveFailures is how many consecutive keepalive@openssh.com
+// failures are tolerated before the connection is considered dead.
+const maxKeepAliveFailures = 3
+
+// ErrHandshakeTimeout is returned by NewSSHClientWithConfig when the SSH
+// handshake does not complete within cfg.HandshakeTimeout.
+var ErrHandshakeTimeout = errors.New("aassh: timeout during SSH handshake")
+
+// TransferMode selects which protocol PushBytes, PushFile, PushDir, and
+// Receive use to move files to/from the remote host.
+type TransferMode int
+
+const (
+	// TransferSFTP uses the sftp subsystem.  It is the default, and falls
+	// back to TransferSCP if the subsystem can't be opened or the transfer
+	// fails.
+	TransferSFTP TransferMode = iota
+	// TransferSCP shells out to /usr/bin/scp on the remote host.
+	TransferSCP
 )
 
 type SSHClient struct {
 	client *ssh.Client
+	// TransferMode controls whether PushBytes, PushFile, PushDir, and
+	// Receive use sftp or scp.  Defaults to TransferSFTP.
+	TransferMode  TransferMode
+	keepAliveErr  chan error
+	keepAliveDone chan struct{}
+	closeOnce     sync.Once
+}
+
+// KeepAliveErr returns a channel that receives at most one error if the
+// keepalive goroutine started by ClientConfig.KeepAliveInterval gives up
+// and closes the connection.  It is nil if KeepAliveInterval was not set.
+func (c *SSHClient) KeepAliveErr() <-chan error {
+	return c.keepAliveErr
+}
+
+// ClientConfig customizes how NewSSHClientWithConfig connects and
+// authenticates, for callers who need more control than NewSSHClient gives.
+type ClientConfig struct {
+	// Username is the remote user to authenticate as.
+	Username string
+	// Password, if non-blank, is tried via ssh.Password.
+	Password string
+	// Passphrase, if non-blank, unlocks encrypted private keys found in
+	// ~/.ssh.
+	Passphrase string
+	// Auth, if non-empty, replaces the default auth method search
+	// (ssh-agent, then ~/.ssh keys, then Password) entirely.
+	Auth []ssh.AuthMethod
+	// HostKeyCallback verifies the remote host key.  Leaving it nil
+	// defaults to ssh.InsecureIgnoreHostKey, which disables host key
+	// verification entirely and leaves the connection open to MITM -
+	// set it explicitly (eg ssh.FixedHostKey or a known_hosts callback)
+	// for anything security-sensitive.
+	HostKeyCallback ssh.HostKeyCallback
+	// Timeout bounds the TCP dial only; the SSH handshake is not bounded by
+	// it.  Zero means no timeout.  It is not used when HandshakeTimeout is
+	// set.
+	Timeout time.Duration
+	// HandshakeTimeout, if non-zero, is used in place of Timeout and bounds
+	// the TCP dial and, separately, the SSH handshake.  A handshake that
+	// exceeds it returns ErrHandshakeTimeout; a dial that exceeds it returns
+	// the dial's own timeout error.  Use this when the remote host may
+	// accept the TCP connection but stall during key exchange.
+	HandshakeTimeout time.Duration
+	// KeepAliveInterval, if non-zero, starts a background goroutine that
+	// sends keepalive@openssh.com requests at that interval.  After
+	// maxKeepAliveFailures consecutive failures the connection is closed
+	// and the error is sent on the channel returned by KeepAliveErr.
+	KeepAliveInterval time.Duration
+}
+
+// defaultAuthMethods builds the ssh-agent, ~/.ssh key, and password auth
+// methods NewSSHClient has always tried, in priority order.
+func defaultAuthMethods(password, passphrase string) []ssh.AuthMethod {
+	var methods []ssh.AuthMethod
+	if a := agentAuth(); a != nil {
+		methods = append(methods, a)
+	}
+	var signers []ssh.Signer
+	for _, v := range keyFiles {
+		key, err := getKey(v, passphrase)
+		if err != nil {
+			continue
+		}
+		signers = append(signers, key)
+	}
+	if len(signers) > 0 {
+		methods = append(methods, ssh.PublicKeys(signers...))
+	}
+	if password != "" {
+		methods = append(methods, ssh.Password(password))
+	}
+	return methods
 }
 
-// getKey tries to grab /home/user/ssh/id_rsa first, then id_dsa, else fails
-func getKey(filename string) (ssh.Signer, error) {
+// keyFiles lists, in order, the ~/.ssh keys defaultAuthMethods loads via
+// getKey.
+var keyFiles = []string{"id_rsa", "id_dsa", "id_ecdsa", "id_ed25519"}
+
+// getKey tries to grab the named file out of ~/.ssh, parsing it with
+// passphrase if the PEM is encrypted and passphrase is non-blank.
+func getKey(filename, passphrase string) (ssh.Signer, error) {
 	usr, err := user.Current()
 	if err != nil {
 		return nil, err
@@ -31,10 +136,95 @@ func getKey(filename string) (ssh.Signer, error) {
 		return nil, err
 	}
 	key, err := ssh.ParsePrivateKey(b)
+	if err == nil {
+		return key, nil
+	}
+	if _, ok := err.(*ssh.PassphraseMissingError); !ok {
+		return nil, err
+	}
+	if passphrase == "" {
+		return nil, err
+	}
+	return ssh.ParsePrivateKeyWithPassphrase(b, []byte(passphrase))
+}
+
+// agentAuth returns an ssh.AuthMethod backed by a running ssh-agent, or nil
+// if SSH_AUTH_SOCK isn't set or the agent can't be reached.
+func agentAuth() ssh.AuthMethod {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return nil
+	}
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		return nil
+	}
+	a := agent.NewClient(conn)
+	return ssh.PublicKeysCallback(a.Signers)
+}
+
+// dialWithTimeout dials addr and completes the SSH handshake, each step
+// bounded by timeout.  A handshake that takes longer returns
+// ErrHandshakeTimeout; a dial that takes longer returns the dial error.
+func dialWithTimeout(network, addr string, cfg *ssh.ClientConfig, timeout time.Duration) (*ssh.Client, error) {
+	conn, err := net.DialTimeout(network, addr, timeout)
 	if err != nil {
 		return nil, err
 	}
-	return key, nil
+	type result struct {
+		client *ssh.Client
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		c, chans, reqs, err := ssh.NewClientConn(conn, addr, cfg)
+		if err != nil {
+			done <- result{nil, err}
+			return
+		}
+		done <- result{ssh.NewClient(c, chans, reqs), nil}
+	}()
+	select {
+	case r := <-done:
+		return r.client, r.err
+	case <-time.After(timeout):
+		conn.Close()
+		return nil, ErrHandshakeTimeout
+	}
+}
+
+// startKeepAlive periodically sends keepalive@openssh.com requests on
+// client, closing it and sending on the returned error channel after
+// maxKeepAliveFailures consecutive failures.  Closing the returned done
+// channel (done by SSHClient.Close) stops the goroutine immediately,
+// without waiting out those failures.
+func startKeepAlive(client *ssh.Client, interval time.Duration) (errc chan error, done chan struct{}) {
+	errc = make(chan error, 1)
+	done = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		failures := 0
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+				if err != nil {
+					failures++
+					if failures >= maxKeepAliveFailures {
+						client.Close()
+						errc <- err
+						return
+					}
+					continue
+				}
+				failures = 0
+			}
+		}
+	}()
+	return errc, done
 }
 
 // RunCmd runs the command given on the host to which the connection is
@@ -56,50 +246,59 @@ func (c *SSHClient) RunCmd(command string) (string, string, error) {
 	return b.String(), e.String(), nil
 }
 
-// Close closes the remote connection.
+// Close closes the remote connection, stopping the keepalive goroutine (if
+// any) immediately rather than leaving it to tick against a dead client
+// until it exhausts maxKeepAliveFailures on its own.
 func (c *SSHClient) Close() error {
+	if c.keepAliveDone != nil {
+		c.closeOnce.Do(func() { close(c.keepAliveDone) })
+	}
 	return c.client.Close()
 }
 
 // NewSSHClient returns a new SSHClient object.
 // hostport should be in format server.name:22
-// password is optional.  it is tried instead of keys if not blank
+// password is optional.  Auth is attempted, in order, via ssh-agent (if
+// SSH_AUTH_SOCK is set), ~/.ssh/id_rsa, id_dsa, id_ecdsa, and id_ed25519,
+// and finally password if not blank.
 func NewSSHClient(username, password, hostport string) (*SSHClient, error) {
-	var client *ssh.Client
-	var err error
-	var key ssh.Signer
-	if password != "" {
-		cfg := &ssh.ClientConfig{
-			User: username,
-			Auth: []ssh.AuthMethod{ssh.Password(password)},
-		}
-		client, err = ssh.Dial("tcp", hostport, cfg)
-		if err != nil {
-			return nil, err
-		}
+	return NewSSHClientWithConfig(hostport, &ClientConfig{
+		Username: username,
+		Password: password,
+	})
+}
 
-		return &SSHClient{client: client}, nil
+// NewSSHClientWithConfig returns a new SSHClient object using cfg to control
+// authentication, host key verification, and timeouts.
+// hostport should be in format server.name:22
+func NewSSHClientWithConfig(hostport string, cfg *ClientConfig) (*SSHClient, error) {
+	auth := cfg.Auth
+	if len(auth) == 0 {
+		auth = defaultAuthMethods(cfg.Password, cfg.Passphrase)
 	}
-
-	for _, v := range []string{"id_rsa", "id_dsa"} {
-		key, err = getKey(v)
-		if err != nil {
-			continue
-		}
-		cfg := &ssh.ClientConfig{
-			User: username,
-			Auth: []ssh.AuthMethod{ssh.PublicKeys(key)},
-		}
-		client, err = ssh.Dial("tcp", hostport, cfg)
-		if err != nil {
-			continue
-		}
-		break
+	hostKeyCallback := cfg.HostKeyCallback
+	if hostKeyCallback == nil {
+		hostKeyCallback = ssh.InsecureIgnoreHostKey()
+	}
+	sshCfg := &ssh.ClientConfig{
+		User:            cfg.Username,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         cfg.Timeout,
+	}
+	var client *ssh.Client
+	var err error
+	if cfg.HandshakeTimeout > 0 {
+		client, err = dialWithTimeout("tcp", hostport, sshCfg, cfg.HandshakeTimeout)
+	} else {
+		client, err = ssh.Dial("tcp", hostport, sshCfg)
 	}
-
 	if err != nil {
 		return nil, err
 	}
-
-	return &SSHClient{client: client}, nil
+	sc := &SSHClient{client: client}
+	if cfg.KeepAliveInterval > 0 {
+		sc.keepAliveErr, sc.keepAliveDone = startKeepAlive(client, cfg.KeepAliveInterval)
+	}
+	return sc, nil
 }